@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	zmq "github.com/pebbe/zmq4"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+// defaultBidirectionalTimeout bounds how long a bidirectional registration
+// waits for a station response when BidirectionalTimeoutMs is unset.
+const defaultBidirectionalTimeout = 5 * time.Second
+
+// registerBidirectional is the /register-bidirectional route: identical to
+// /register, except it blocks until the assigned station publishes back a
+// S2CInitiateResponse and returns it in the body instead of replying 204.
+func (s *server) registerBidirectional(w http.ResponseWriter, r *http.Request) {
+	s.handleRegister(w, r, true)
+}
+
+// registerPending reserves a correlation slot for correlationID and returns
+// the channel its eventual S2CInitiateResponse will be delivered on. Must
+// be called before the registration is handed to messageAccepter, so a
+// station that replies instantly can't race ahead of the waiter.
+func (s *server) registerPending(correlationID string) chan *pb.S2CInitiateResponse {
+	ch := make(chan *pb.S2CInitiateResponse, 1)
+
+	s.pendingMu.Lock()
+	if s.pending == nil {
+		s.pending = make(map[string]chan *pb.S2CInitiateResponse)
+	}
+	s.pending[correlationID] = ch
+	s.pendingMu.Unlock()
+
+	return ch
+}
+
+// unregisterPending releases the correlation slot reserved by
+// registerPending. Safe to call whether or not a response ever arrived.
+func (s *server) unregisterPending(correlationID string) {
+	s.pendingMu.Lock()
+	delete(s.pending, correlationID)
+	s.pendingMu.Unlock()
+}
+
+// deliverStationResponse hands resp off to whichever HTTP request is
+// waiting on correlationID, if any. Called from the station response
+// listener goroutine spawned by awaitStationResponses.
+func (s *server) deliverStationResponse(correlationID string, resp *pb.S2CInitiateResponse) {
+	s.pendingMu.Lock()
+	ch, ok := s.pending[correlationID]
+	s.pendingMu.Unlock()
+
+	if !ok {
+		// No HTTP handler is waiting, either because this was a plain
+		// unidirectional registration or because the waiter already
+		// timed out.
+		return
+	}
+
+	select {
+	case ch <- resp:
+	default:
+	}
+}
+
+// bidirectionalTimeout returns the configured wait for a station response,
+// falling back to defaultBidirectionalTimeout when unset.
+func (s *server) bidirectionalTimeout() time.Duration {
+	if s.BidirectionalTimeoutMs <= 0 {
+		return defaultBidirectionalTimeout
+	}
+	return time.Duration(s.BidirectionalTimeoutMs) * time.Millisecond
+}
+
+// writeStationResponse waits on respCh for the station's S2CInitiateResponse
+// and writes it to w as a protobuf body, or writes a typed timeout error
+// proto with 504 if none arrives in time.
+func (s *server) writeStationResponse(w http.ResponseWriter, respCh chan *pb.S2CInitiateResponse) {
+	select {
+	case resp := <-respCh:
+		out, err := proto.Marshal(resp)
+		if err != nil {
+			s.logger.Println("failed to marshal station response:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+
+	case <-time.After(s.bidirectionalTimeout()):
+		errCode := pb.S2CInitiateResponse_Timeout
+		timeoutResp := &pb.S2CInitiateResponse{ErrorCode: &errCode}
+		out, err := proto.Marshal(timeoutResp)
+		if err != nil {
+			s.logger.Println("failed to marshal station response timeout:", err)
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusGatewayTimeout)
+		w.Write(out)
+	}
+}
+
+// awaitStationResponses connects a ZMQ SUB socket to every configured
+// station_response_endpoints and, for the lifetime of the process,
+// delivers each S2CInitiateResponse it receives to the HTTP handler
+// waiting on the matching correlation ID. Publishers are expected to send
+// two frames: the correlation ID (the registration's hex shared secret,
+// truncated to regIDLen, exactly as logged by processC2SWrapper) and the
+// serialized S2CInitiateResponse. A no-op when no endpoints are configured.
+func (s *server) awaitStationResponses() error {
+	if len(s.StationResponseEndpoints) == 0 {
+		return nil
+	}
+
+	sock, err := zmq.NewSocket(zmq.SUB)
+	if err != nil {
+		return fmt.Errorf("failed to create station response socket: %v", err)
+	}
+
+	if err := sock.SetSubscribe(""); err != nil {
+		return fmt.Errorf("failed to subscribe station response socket: %v", err)
+	}
+
+	for _, endpoint := range s.StationResponseEndpoints {
+		if err := sock.Connect(endpoint); err != nil {
+			return fmt.Errorf("failed to connect to station response endpoint %s: %v", endpoint, err)
+		}
+	}
+
+	// RcvTimeo bounds how long a single Recv call blocks, so the loop below
+	// wakes up periodically to check stationStop instead of blocking on the
+	// socket forever.
+	if err := sock.SetRcvtimeo(time.Second); err != nil {
+		return fmt.Errorf("failed to set station response socket timeout: %v", err)
+	}
+
+	s.stationStop = make(chan struct{})
+	s.stationDone = make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-s.stationStop:
+				if err := sock.Close(); err != nil {
+					s.logger.Println("failed to close station response socket:", err)
+				}
+				close(s.stationDone)
+				return
+			default:
+			}
+
+			frames, err := sock.RecvMessageBytes(0)
+			if err != nil {
+				if err == syscall.EAGAIN {
+					continue
+				}
+				s.logger.Println("failed to receive station response:", err)
+				continue
+			}
+			if len(frames) != 2 {
+				s.logger.Println("dropping malformed station response with", len(frames), "frames")
+				continue
+			}
+
+			resp := &pb.S2CInitiateResponse{}
+			if err := proto.Unmarshal(frames[1], resp); err != nil {
+				s.logger.Println("failed to decode station response:", err)
+				continue
+			}
+
+			s.deliverStationResponse(string(frames[0]), resp)
+		}
+	}()
+
+	return nil
+}
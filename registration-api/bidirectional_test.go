@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+func TestDeliverStationResponseWakesMatchingWaiter(t *testing.T) {
+	s := &server{}
+	respCh := s.registerPending("deadbeef")
+	defer s.unregisterPending("deadbeef")
+
+	want := &pb.S2CInitiateResponse{}
+	s.deliverStationResponse("deadbeef", want)
+
+	select {
+	case got := <-respCh:
+		if got != want {
+			t.Fatalf("deliverStationResponse() delivered %v, want %v", got, want)
+		}
+	default:
+		t.Fatal("deliverStationResponse() did not deliver to the registered channel")
+	}
+}
+
+func TestDeliverStationResponseIgnoresUnknownCorrelationID(t *testing.T) {
+	s := &server{}
+	respCh := s.registerPending("deadbeef")
+	defer s.unregisterPending("deadbeef")
+
+	// A response for a correlation ID nobody registered (e.g. a station
+	// reply for an already-timed-out or unidirectional registration) must
+	// not panic and must not be delivered to an unrelated waiter.
+	s.deliverStationResponse("c0ffee", &pb.S2CInitiateResponse{})
+
+	select {
+	case <-respCh:
+		t.Fatal("deliverStationResponse() delivered a response for a different correlation ID")
+	default:
+	}
+}
+
+func TestWriteStationResponseDeliversResponse(t *testing.T) {
+	s := &server{}
+	respCh := make(chan *pb.S2CInitiateResponse, 1)
+	respCh <- &pb.S2CInitiateResponse{}
+
+	w := httptest.NewRecorder()
+	s.writeStationResponse(w, respCh)
+
+	if w.Code != 200 {
+		t.Fatalf("writeStationResponse() status = %d, want 200", w.Code)
+	}
+
+	got := &pb.S2CInitiateResponse{}
+	if err := proto.Unmarshal(w.Body.Bytes(), got); err != nil {
+		t.Fatalf("failed to unmarshal response body: %v", err)
+	}
+}
+
+func TestWriteStationResponseTimesOut(t *testing.T) {
+	s := &server{}
+	s.BidirectionalTimeoutMs = 10
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		s.writeStationResponse(w, make(chan *pb.S2CInitiateResponse))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writeStationResponse() did not return after its configured timeout")
+	}
+
+	if w.Code != 504 {
+		t.Fatalf("writeStationResponse() status = %d, want 504", w.Code)
+	}
+
+	got := &pb.S2CInitiateResponse{}
+	if err := proto.Unmarshal(w.Body.Bytes(), got); err != nil {
+		t.Fatalf("failed to unmarshal timeout response body: %v", err)
+	}
+	if got.GetErrorCode() != pb.S2CInitiateResponse_Timeout {
+		t.Fatalf("timeout response ErrorCode = %v, want Timeout", got.GetErrorCode())
+	}
+}
+
+func TestBidirectionalTimeoutDefault(t *testing.T) {
+	s := &server{}
+	if got := s.bidirectionalTimeout(); got != defaultBidirectionalTimeout {
+		t.Fatalf("bidirectionalTimeout() with BidirectionalTimeoutMs unset = %v, want %v", got, defaultBidirectionalTimeout)
+	}
+}
+
+func TestBidirectionalTimeoutConfigured(t *testing.T) {
+	s := &server{}
+	s.BidirectionalTimeoutMs = 250
+	if got, want := s.bidirectionalTimeout(), 250*time.Millisecond; got != want {
+		t.Fatalf("bidirectionalTimeout() = %v, want %v", got, want)
+	}
+}
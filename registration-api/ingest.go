@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	zmq "github.com/pebbe/zmq4"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+// errIngestStopped is returned by the control socket handler to make the
+// reactor's Run loop exit on shutdown; it isn't a real error.
+var errIngestStopped = errors.New("ingest reactor stopped")
+
+// setupIngest binds a CURVE-authenticated ZMQ PULL socket that remote
+// registrars (bridge frontends, decoy stations, partner relays) can push
+// pre-built C2SWrapper protobufs into directly, so the API acts as a
+// registration hub rather than an HTTP-only frontend. It is a no-op when
+// ZMQIngestPort is unset.
+func (s *server) setupIngest() error {
+	if s.ZMQIngestPort == 0 {
+		return nil
+	}
+
+	sock, err := zmq.NewSocket(zmq.PULL)
+	if err != nil {
+		return fmt.Errorf("failed to create zmq ingest socket: %v", err)
+	}
+
+	if err := s.setupIngestAuth(sock); err != nil {
+		return fmt.Errorf("failed to set up ingest auth: %v", err)
+	}
+
+	if err := sock.Bind(fmt.Sprintf("tcp://*:%d", s.ZMQIngestPort)); err != nil {
+		return fmt.Errorf("failed to bind zmq ingest socket: %v", err)
+	}
+
+	// An inproc PAIR is how loadNewConfig (running on the signal-handling
+	// goroutine) tells the reactor (running on its own goroutine, which
+	// alone is allowed to touch sock) to re-authorize IngestPublicKeys
+	// after a reload.
+	controlOut, err := zmq.NewSocket(zmq.PAIR)
+	if err != nil {
+		return fmt.Errorf("failed to create ingest control socket: %v", err)
+	}
+	if err := controlOut.Bind("inproc://ingest-control"); err != nil {
+		return fmt.Errorf("failed to bind ingest control socket: %v", err)
+	}
+
+	controlIn, err := zmq.NewSocket(zmq.PAIR)
+	if err != nil {
+		return fmt.Errorf("failed to create ingest control socket: %v", err)
+	}
+	if err := controlIn.Connect("inproc://ingest-control"); err != nil {
+		return fmt.Errorf("failed to connect ingest control socket: %v", err)
+	}
+
+	s.ingestSock = sock
+	s.ingestControl = controlOut
+	s.ingestDone = make(chan struct{})
+
+	go s.runIngestReactor(sock, controlIn)
+
+	s.logger.Printf("bound zmq ingest socket on port %d\n", s.ZMQIngestPort)
+	return nil
+}
+
+// runIngestReactor multiplexes the ingest PULL socket and its control PAIR
+// socket on a single goroutine, the way the zmq4 lb-broker examples
+// multiplex a broker's frontend and backend sockets. It owns both sockets
+// for their lifetime; nothing else may call methods on them, which is why
+// shutdown asks it to close them itself (via a "stop" control message)
+// rather than closing sock/control directly.
+func (s *server) runIngestReactor(sock *zmq.Socket, control *zmq.Socket) {
+	reactor := zmq.NewReactor()
+
+	reactor.AddSocket(sock, zmq.POLLIN, func(zmq.State) error {
+		frame, err := sock.RecvBytes(0)
+		if err != nil {
+			s.logger.Println("failed to receive ingest frame:", err)
+			return nil
+		}
+		s.handleIngestFrame(frame)
+		return nil
+	})
+
+	reactor.AddSocket(control, zmq.POLLIN, func(zmq.State) error {
+		msg, err := control.RecvMessage(0)
+		if err != nil {
+			s.logger.Println("failed to receive ingest control message:", err)
+			return nil
+		}
+		if len(msg) > 0 && msg[0] == "stop" {
+			return errIngestStopped
+		}
+		if err := s.setupIngestAuth(sock); err != nil {
+			s.logger.Println("failed to reload ingest auth, keeping previous ingest pubkeys:", err)
+		}
+		return nil
+	})
+
+	if err := reactor.Run(-1); err != nil && err != errIngestStopped {
+		s.logger.Println("ingest reactor exited:", err)
+	}
+
+	if err := sock.Close(); err != nil {
+		s.logger.Println("failed to close zmq ingest socket:", err)
+	}
+	if err := control.Close(); err != nil {
+		s.logger.Println("failed to close ingest control socket:", err)
+	}
+	close(s.ingestDone)
+}
+
+// handleIngestFrame decodes a single C2SWrapper frame received on the ZMQ
+// ingest socket and forwards it through the same processC2SWrapper /
+// messageAccepter pipeline used by the HTTP /register route.
+func (s *server) handleIngestFrame(frame []byte) {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	payload := &pb.C2SWrapper{}
+	if err := proto.Unmarshal(frame, payload); err != nil {
+		s.logger.Println("failed to decode ingest protobuf:", err)
+		return
+	}
+
+	// Registrars pushing over the ingest socket are expected to set their
+	// own RegistrationSource; default to BidirectionalAPI for ones that
+	// don't, since they arrived over the same out-of-band channel used by
+	// non-HTTP registrars rather than the plain HTTP API.
+	if payload.GetRegistrationSource() == pb.RegistrationSource_Unspecified {
+		source := pb.RegistrationSource_BidirectionalAPI
+		payload.RegistrationSource = &source
+	}
+
+	// Relays that don't know (or wish to forward) the originating client
+	// address leave RegistrationAddress unset; zero it out explicitly
+	// rather than leaving it nil, matching the HTTP path's clientAddrBytes.
+	clientAddrBytes := make([]byte, 16, 16)
+	if addr := payload.GetRegistrationAddress(); len(addr) == 16 {
+		clientAddrBytes = addr
+	}
+
+	zmqPayload, err := s.processC2SWrapper(payload, clientAddrBytes)
+	if err != nil {
+		s.logger.Println("failed to process ingested registration:", err)
+		return
+	}
+
+	if err := s.messageAccepter(zmqPayload); err != nil {
+		s.logger.Println("failed to publish ingested registration:", err)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/gorilla/mux"
 	zmq "github.com/pebbe/zmq4"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	pb "github.com/refraction-networking/gotapdance/protobuf"
 )
 
@@ -35,6 +36,43 @@ type config struct {
 	AuthVerbose       bool     `toml:"auth_verbose"`
 	StationPublicKeys []string `toml:"station_pubkeys"`
 
+	// ZMQIngestPort, when non-zero, binds a second CURVE-authenticated ZMQ
+	// PULL socket that remote registrars can push pre-built C2SWrapper
+	// protobufs into directly, bypassing the HTTP API.
+	ZMQIngestPort    uint16   `toml:"zmq_ingest_port"`
+	IngestPublicKeys []string `toml:"ingest_pubkeys"`
+
+	// StationResponseEndpoints are ZMQ endpoints stations publish
+	// S2CInitiateResponse messages to, used by /register-bidirectional to
+	// learn the station-assigned phantom/DNAT parameters for a
+	// registration. BidirectionalTimeoutMs bounds how long a bidirectional
+	// request waits for that response before failing with 504.
+	StationResponseEndpoints []string `toml:"station_response_endpoints"`
+	BidirectionalTimeoutMs   int      `toml:"bidirectional_timeout_ms"`
+
+	// Transport selects the backend messageAccepter publishes processed
+	// registrations to: "zmq-pub" (the default), "kafka", "nats", or
+	// "multi" to fan out to all of the above that have config set.
+	Transport    string   `toml:"transport"`
+	KafkaBrokers []string `toml:"kafka_brokers"`
+	KafkaTopic   string   `toml:"kafka_topic"`
+	NATSUrl      string   `toml:"nats_url"`
+
+	// TrustedProxyCIDRs lists the CIDRs of upstream proxies allowed to set
+	// X-Forwarded-For; a request from anywhere else has its header
+	// ignored so it can't be spoofed to dodge per-IP rate limiting.
+	TrustedProxyCIDRs []string `toml:"trusted_proxy_cidrs"`
+
+	// RateLimitBackend selects where rate limiter state lives: "memory"
+	// (the default, an in-process golang.org/x/time/rate limiter per key)
+	// or "redis" for multi-instance deployments sharing limiter state.
+	RateLimitBackend        string  `toml:"rate_limit_backend"`
+	RateLimitPerIPRPS       float64 `toml:"rate_limit_per_ip_rps"`
+	RateLimitPerIPBurst     int     `toml:"rate_limit_per_ip_burst"`
+	RateLimitPerSecretRPS   float64 `toml:"rate_limit_per_secret_rps"`
+	RateLimitPerSecretBurst int     `toml:"rate_limit_per_secret_burst"`
+	RedisAddr               string  `toml:"redis_addr"`
+
 	// Parsed from conjure.conf environment vars
 	logClientIP bool
 }
@@ -49,24 +87,113 @@ type server struct {
 
 	logger *log.Logger
 	sock   *zmq.Socket
+
+	// ingestSock is the optional ZMQ PULL socket set up by setupIngest.
+	// It is owned by the goroutine running runIngestReactor; other
+	// goroutines must not touch it directly and instead signal changes
+	// through ingestControl.
+	ingestSock *zmq.Socket
+
+	// ingestControl is the sending half of an inproc PAIR socket used to
+	// tell the ingest reactor goroutine to refresh its allowed CURVE keys
+	// after a config reload, or to stop on shutdown. Nil if ingest is not
+	// enabled. ingestControlMu serializes sends to it, since a reload
+	// (SIGHUP) and shutdown (SIGINT/SIGTERM) run on separate goroutines and
+	// a ZMQ socket may only be used by one goroutine at a time.
+	ingestControl   *zmq.Socket
+	ingestControlMu sync.Mutex
+
+	// ingestDone is closed by runIngestReactor once it has finished
+	// closing ingestSock and its own end of the control PAIR in response
+	// to a "stop" message, so shutdown can wait for that before closing
+	// ingestControl and tearing down the transport.
+	ingestDone chan struct{}
+
+	// pendingMu guards pending, the map of in-flight bidirectional
+	// registrations keyed on correlation ID (the registration's hex
+	// shared secret, truncated to regIDLen) to the channel its
+	// S2CInitiateResponse should be delivered on.
+	pendingMu sync.Mutex
+	pending   map[string]chan *pb.S2CInitiateResponse
+
+	// transport is the backend messageAccepter publishes to, selected by
+	// setupTransport according to the Transport config field.
+	transport Transport
+
+	// limiter is the rate limiter placed in front of register, selected by
+	// setupLimiter. Nil disables rate limiting entirely.
+	limiter Limiter
+
+	// trustedProxies is TrustedProxyCIDRs parsed into *net.IPNet by
+	// setupLimiter; only requests whose direct peer matches one of these
+	// have their X-Forwarded-For header honored.
+	trustedProxies []*net.IPNet
+
+	metrics *metrics
+
+	// wg tracks in-flight registrations (both HTTP and ingest-sourced) so
+	// shutdown can drain them before tearing down the transport.
+	wg sync.WaitGroup
+
+	// stationStop/stationDone stop the station response listener goroutine
+	// spawned by awaitStationResponses on shutdown: closing stationStop
+	// tells the loop to exit, and it closes stationDone once its socket is
+	// closed. Both nil if no station_response_endpoints are configured.
+	stationStop chan struct{}
+	stationDone chan struct{}
 }
 
-// Get the first element of the X-Forwarded-For header if it is available, this
-// will be the clients address if intermediate proxies follow X-Forwarded-For
+// Get the first element of the X-Forwarded-For header if it is available and
+// the request came from a configured trusted proxy, this will be the
+// clients address if intermediate proxies follow X-Forwarded-For
 // specification (as seen here: https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/X-Forwarded-For).
 // Otherwise return the remote address specified in the request.
 //
 // In the future this may need to handle True-Client-IP headers.
-func getRemoteAddr(r *http.Request) string {
-	if r.Header.Get("X-Forwarded-For") != "" {
+func (s *server) getRemoteAddr(r *http.Request) string {
+	if r.Header.Get("X-Forwarded-For") != "" && s.isTrustedProxy(r.RemoteAddr) {
 		addrList := r.Header.Get("X-Forwarded-For")
 		return strings.Trim(strings.Split(addrList, ",")[0], " \t")
 	}
 	return r.RemoteAddr
 }
 
+// isTrustedProxy reports whether remoteAddr (the direct TCP peer of the
+// request, host:port or host-only) falls within one of TrustedProxyCIDRs.
+// An empty TrustedProxyCIDRs means X-Forwarded-For is never honored.
+func (s *server) isTrustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, cidr := range s.trustedProxies {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *server) register(w http.ResponseWriter, r *http.Request) {
-	requestIP := getRemoteAddr(r)
+	s.handleRegister(w, r, false)
+}
+
+// handleRegister implements both the plain /register route and the
+// bidirectional /register-bidirectional route. When bidirectional is true
+// (either because of the route or because the incoming C2SWrapper already
+// carries RegistrationSource_BidirectionalAPI) it blocks for the assigned
+// station's S2CInitiateResponse instead of returning 204 immediately.
+func (s *server) handleRegister(w http.ResponseWriter, r *http.Request, bidirectional bool) {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	requestIP := s.getRemoteAddr(r)
 
 	if s.logClientIP {
 		s.logger.Printf("received %s request from IP %v with content-length %d\n", r.Method, requestIP, r.ContentLength)
@@ -74,6 +201,13 @@ func (s *server) register(w http.ResponseWriter, r *http.Request) {
 		s.logger.Printf("received %s request from IP _ with content-length %d\n", r.Method, r.ContentLength)
 	}
 
+	if s.limiter != nil && !s.limiter.AllowIP(requestIP) {
+		s.metrics.rateLimitRejects.WithLabelValues("ip").Inc()
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+
 	const MinimumRequestLength = SecretLength + 1 // shared_secret + VSP
 	if r.Method != "POST" {
 		s.logger.Printf("rejecting request due to incorrect method %s\n", r.Method)
@@ -93,6 +227,7 @@ func (s *server) register(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to read request body", http.StatusBadRequest)
 		return
 	}
+	s.metrics.bytesIn.Add(float64(len(in)))
 
 	payload := &pb.C2SWrapper{}
 	if err = proto.Unmarshal(in, payload); err != nil {
@@ -101,12 +236,24 @@ func (s *server) register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.limiter != nil && len(payload.GetSharedSecret()) >= regIDLen/2 {
+		prefix := hex.EncodeToString(payload.GetSharedSecret())[:regIDLen]
+		if !s.limiter.AllowSecretPrefix(prefix) {
+			s.metrics.rateLimitRejects.WithLabelValues("secret_prefix").Inc()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+	}
+
 	clientAddr := parseIP(requestIP)
 	var clientAddrBytes = make([]byte, 16, 16)
 	if clientAddr != nil {
 		clientAddrBytes = []byte(clientAddr.To16())
 	}
 
+	bidirectional = bidirectional || payload.GetRegistrationSource() == pb.RegistrationSource_BidirectionalAPI
+
 	zmqPayload, err := s.processC2SWrapper(payload, clientAddrBytes)
 	if err != nil {
 		s.logger.Println("failed to marshal ClientToStation into VSP:", err)
@@ -114,6 +261,19 @@ func (s *server) register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The correlation ID used to match this registration to the station's
+	// eventual response is the same registration ID already used for
+	// logging above, so it must be reserved before the registration is
+	// handed off, or a station that replies instantly could race ahead of
+	// the waiter below.
+	var respCh chan *pb.S2CInitiateResponse
+	var correlationID string
+	if bidirectional {
+		correlationID = hex.EncodeToString(payload.GetSharedSecret())[:regIDLen]
+		respCh = s.registerPending(correlationID)
+		defer s.unregisterPending(correlationID)
+	}
+
 	err = s.messageAccepter(zmqPayload)
 	if err != nil {
 		s.logger.Println("failed to publish registration:", err)
@@ -121,10 +281,15 @@ func (s *server) register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// We could send an HTTP response earlier to avoid waiting
-	// while the zmq socket is locked, but this ensures that
-	// a 204 truly indicates registration success.
-	w.WriteHeader(http.StatusNoContent)
+	if !bidirectional {
+		// We could send an HTTP response earlier to avoid waiting
+		// while the zmq socket is locked, but this ensures that
+		// a 204 truly indicates registration success.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	s.writeStationResponse(w, respCh)
 }
 
 func (s *server) sendToZMQ(message []byte) error {
@@ -132,7 +297,13 @@ func (s *server) sendToZMQ(message []byte) error {
 	_, err := s.sock.SendBytes(message, zmq.DONTWAIT)
 	s.Unlock()
 
-	return err
+	if err != nil {
+		s.metrics.zmqSendErrors.Inc()
+		return err
+	}
+	s.metrics.bytesOut.Add(float64(len(message)))
+
+	return nil
 }
 
 func (s *server) processC2SWrapper(clientToAPIProto *pb.C2SWrapper, clientAddr []byte) ([]byte, error) {
@@ -174,7 +345,8 @@ func (s *server) processC2SWrapper(clientToAPIProto *pb.C2SWrapper, clientAddr [
 
 // setupReloadHandler spawns a lightweight thread to listen for reload signals
 // and loads updated configurations for the registration-api process everytime
-// the reload signal is received
+// the reload signal is received. SIGINT/SIGTERM (process shutdown) are
+// handled separately by awaitShutdown.
 func (s *server) setupReloadHandler() {
 	signalChan := make(chan os.Signal, 1)
 
@@ -187,6 +359,7 @@ func (s *server) setupReloadHandler() {
 	go func() {
 		for {
 			<-signalChan
+			s.metrics.reloadSignals.Inc()
 			s.loadNewConfig()
 		}
 	}()
@@ -194,52 +367,109 @@ func (s *server) setupReloadHandler() {
 
 // loadNewConfig reads configuration for registration-api, and updates all
 // in-memory configs other than the ports. Updating the port of ZMQ socket
-// and/or the port of the application should require a restart.
+// and/or the port of the application should require a restart. A bad
+// config file logs and keeps the previous config rather than killing the
+// process, since this runs off a SIGHUP that operators expect to be safe.
 func (s *server) loadNewConfig() {
 	s.Lock()
 	defer s.Unlock()
 
 	s.logger.Printf("reloading config for registration API")
 
-	_, err := toml.DecodeFile(os.Getenv("CJ_API_CONFIG"), &s)
-	if err != nil {
-		s.logger.Fatalln("failed to load config:", err)
+	newConf := s.config
+	if _, err := toml.DecodeFile(os.Getenv("CJ_API_CONFIG"), &newConf); err != nil {
+		s.logger.Println("failed to load config, keeping previous config:", err)
+		return
 	}
+	s.config = newConf
 
 	// AuthStart() is not idempotent, must explictly stop auth before updating curve
 	zmq.AuthStop()
 	// update the auth curve of the ZMQ socket without creating a new one
-	s.setupAuth(s.sock)
-}
+	if err := s.setupAuth(s.sock); err != nil {
+		s.logger.Println("failed to reload zmq auth, station pubkeys may not be applied:", err)
+	}
 
-// setupAuth resets the auth settings based on the configuration
-func (s *server) setupAuth(sock *zmq.Socket) {
-	if s.AuthType == "CURVE" {
-		// always read from key path everytime this function is called because
-		// even if the key path stays the same, the key content may have changed
-		privkeyBytes, err := ioutil.ReadFile(s.PrivateKeyPath)
-		if err != nil {
-			s.logger.Fatalln("failed to get private key:", err)
+	// The ingest socket is owned by a different goroutine, so it can't be
+	// touched from here directly; signal it to redo its own auth setup
+	// against the (possibly rotated) IngestPublicKeys. ingestControlMu
+	// keeps this from racing stopIngest's own send on the same socket if
+	// a SIGHUP and a shutdown signal land at the same time.
+	s.ingestControlMu.Lock()
+	if s.ingestControl != nil {
+		if _, err := s.ingestControl.SendMessage("reload"); err != nil {
+			s.logger.Println("failed to signal ingest reactor to reload:", err)
 		}
+	}
+	s.ingestControlMu.Unlock()
+
+	// Re-derive trusted proxies and rebuild the rate limiter so a reload
+	// can adjust limits without a restart; in-process counters reset, a
+	// Redis-backed limiter's do not.
+	if err := s.setupLimiter(); err != nil {
+		s.logger.Println("failed to reload rate limiter config:", err)
+	}
+}
+
+// setupAuth resets the auth settings based on the configuration. Returns an
+// error instead of dying outright so a bad config (e.g. on SIGHUP reload)
+// can be logged and recovered from by the caller.
+func (s *server) setupAuth(sock *zmq.Socket) error {
+	if s.AuthType != "CURVE" {
+		return nil
+	}
+
+	// always read from key path everytime this function is called because
+	// even if the key path stays the same, the key content may have changed
+	privkeyBytes, err := ioutil.ReadFile(s.PrivateKeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to get private key: %v", err)
+	}
 
-		privkey := zmq.Z85encode(string(privkeyBytes[:32]))
+	privkey := zmq.Z85encode(string(privkeyBytes[:32]))
 
-		zmq.AuthSetVerbose(s.AuthVerbose)
+	zmq.AuthSetVerbose(s.AuthVerbose)
 
-		err = zmq.AuthStart()
-		if err != nil {
-			s.logger.Fatalln("failed to start zmq auth:", err)
-		}
+	if err := zmq.AuthStart(); err != nil {
+		return fmt.Errorf("failed to start zmq auth: %v", err)
+	}
 
-		s.logger.Println(s.StationPublicKeys)
-		zmq.AuthAllow("*")
-		zmq.AuthCurveAdd("*", s.StationPublicKeys...)
+	s.logger.Println(s.StationPublicKeys)
+	zmq.AuthAllow("*")
+	zmq.AuthCurveAdd("*", s.StationPublicKeys...)
 
-		err = sock.ServerAuthCurve("*", privkey)
-		if err != nil {
-			s.logger.Fatalln("failed to set up auth on zmq socket:", err)
-		}
+	if err := sock.ServerAuthCurve("*", privkey); err != nil {
+		return fmt.Errorf("failed to set up auth on zmq socket: %v", err)
 	}
+
+	return nil
+}
+
+// setupIngestAuth authorizes the configured IngestPublicKeys on their own
+// "ingest" ZAP domain, independent of the "*" domain used by the main PUB
+// socket's StationPublicKeys. This lets the two key lists be rotated
+// independently on reload. Assumes zmq.AuthStart() has already been called
+// by setupAuth. Returns an error instead of dying outright so a bad config
+// (e.g. on SIGHUP reload) can be logged and recovered from by the caller.
+func (s *server) setupIngestAuth(sock *zmq.Socket) error {
+	if s.AuthType != "CURVE" {
+		return nil
+	}
+
+	privkeyBytes, err := ioutil.ReadFile(s.PrivateKeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to get private key: %v", err)
+	}
+
+	privkey := zmq.Z85encode(string(privkeyBytes[:32]))
+
+	zmq.AuthCurveAdd("ingest", s.IngestPublicKeys...)
+
+	if err := sock.ServerAuthCurve("ingest", privkey); err != nil {
+		return fmt.Errorf("failed to set up auth on zmq ingest socket: %v", err)
+	}
+
+	return nil
 }
 
 // parseIP attempts to parse the IP address of a request from string format wether
@@ -266,7 +496,7 @@ func parseIP(addrPort string) *net.IP {
 func main() {
 	var s server
 	s.logger = log.New(os.Stdout, "[API] ", log.Ldate|log.Lmicroseconds)
-	s.messageAccepter = s.sendToZMQ
+	s.metrics = newMetrics()
 
 	_, err := toml.DecodeFile(os.Getenv("CJ_API_CONFIG"), &s)
 	if err != nil {
@@ -285,7 +515,9 @@ func main() {
 		s.logger.Fatalln("failed to create zmq socket:", err)
 	}
 
-	s.setupAuth(sock)
+	if err := s.setupAuth(sock); err != nil {
+		s.logger.Fatalln("failed to set up zmq auth:", err)
+	}
 
 	err = sock.Bind(fmt.Sprintf("tcp://*:%d", s.ZMQPort))
 	if err != nil {
@@ -295,13 +527,41 @@ func main() {
 
 	s.logger.Println("bound zmq socket")
 
+	if err := s.setupTransport(); err != nil {
+		s.logger.Fatalln("failed to set up transport:", err)
+	}
+
+	if err := s.setupLimiter(); err != nil {
+		s.logger.Fatalln("failed to set up rate limiter:", err)
+	}
+
+	if err := s.setupIngest(); err != nil {
+		s.logger.Fatalln("failed to set up zmq ingest socket:", err)
+	}
+
 	s.logger.Printf("starting HTTP API on port %d\n", s.APIPort)
 
+	if err := s.awaitStationResponses(); err != nil {
+		s.logger.Fatalln("failed to set up station response listener:", err)
+	}
+
 	r := mux.NewRouter()
 	r.HandleFunc("/register", s.register)
-	http.Handle("/", r)
+	r.HandleFunc("/register-bidirectional", s.registerBidirectional)
+	r.Handle("/metrics", promhttp.Handler())
+
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", s.APIPort),
+		Handler: r,
+	}
 
 	s.setupReloadHandler()
 
-	s.logger.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", s.APIPort), nil))
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			s.logger.Fatalln("http server error:", err)
+		}
+	}()
+
+	s.awaitShutdown(httpServer)
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+func newTestServer() *server {
+	s := &server{}
+	s.logger = log.New(ioutil.Discard, "", 0)
+	return s
+}
+
+func TestProcessC2SWrapperRejectsNil(t *testing.T) {
+	s := newTestServer()
+	if _, err := s.processC2SWrapper(nil, nil); err == nil {
+		t.Fatal("processC2SWrapper(nil) = nil error, want error")
+	}
+}
+
+func TestProcessC2SWrapperRejectsShortSecret(t *testing.T) {
+	s := newTestServer()
+	in := &pb.C2SWrapper{SharedSecret: []byte{0x01, 0x02}}
+	if _, err := s.processC2SWrapper(in, nil); err == nil {
+		t.Fatal("processC2SWrapper() with a too-short shared secret = nil error, want error")
+	}
+}
+
+func TestProcessC2SWrapperDefaultsSourceToAPIAndUsesClientAddr(t *testing.T) {
+	s := newTestServer()
+	secret := bytes.Repeat([]byte{0xAB}, SecretLength)
+	clientAddr := bytes.Repeat([]byte{0x01}, 16)
+
+	in := &pb.C2SWrapper{SharedSecret: secret}
+	marshaled, err := s.processC2SWrapper(in, clientAddr)
+	if err != nil {
+		t.Fatalf("processC2SWrapper() = %v, want no error", err)
+	}
+
+	out := &pb.C2SWrapper{}
+	if err := proto.Unmarshal(marshaled, out); err != nil {
+		t.Fatalf("failed to unmarshal processed C2SWrapper: %v", err)
+	}
+
+	if out.GetRegistrationSource() != pb.RegistrationSource_API {
+		t.Errorf("RegistrationSource = %v, want API", out.GetRegistrationSource())
+	}
+	if !bytes.Equal(out.GetRegistrationAddress(), clientAddr) {
+		t.Errorf("RegistrationAddress = %v, want %v (client addr, since none was set on the wrapper)", out.GetRegistrationAddress(), clientAddr)
+	}
+	if !bytes.Equal(out.GetSharedSecret(), secret) {
+		t.Errorf("SharedSecret = %v, want %v", out.GetSharedSecret(), secret)
+	}
+}
+
+func TestProcessC2SWrapperPreservesProvidedSourceAndAddress(t *testing.T) {
+	s := newTestServer()
+	secret := bytes.Repeat([]byte{0xCD}, SecretLength)
+	wrapperAddr := bytes.Repeat([]byte{0x02}, 16)
+	clientAddr := bytes.Repeat([]byte{0x03}, 16)
+	source := pb.RegistrationSource_BidirectionalAPI
+
+	in := &pb.C2SWrapper{
+		SharedSecret:        secret,
+		RegistrationSource:  &source,
+		RegistrationAddress: wrapperAddr,
+	}
+	marshaled, err := s.processC2SWrapper(in, clientAddr)
+	if err != nil {
+		t.Fatalf("processC2SWrapper() = %v, want no error", err)
+	}
+
+	out := &pb.C2SWrapper{}
+	if err := proto.Unmarshal(marshaled, out); err != nil {
+		t.Fatalf("failed to unmarshal processed C2SWrapper: %v", err)
+	}
+
+	// A non-API source's own RegistrationAddress should be kept rather
+	// than overwritten with the HTTP/ingest-observed clientAddr.
+	if out.GetRegistrationSource() != pb.RegistrationSource_BidirectionalAPI {
+		t.Errorf("RegistrationSource = %v, want BidirectionalAPI", out.GetRegistrationSource())
+	}
+	if !bytes.Equal(out.GetRegistrationAddress(), wrapperAddr) {
+		t.Errorf("RegistrationAddress = %v, want %v (wrapper-provided, not overwritten)", out.GetRegistrationAddress(), wrapperAddr)
+	}
+}
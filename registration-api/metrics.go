@@ -0,0 +1,49 @@
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// metrics holds the Prometheus collectors exposed on /metrics.
+type metrics struct {
+	rateLimitRejects *prometheus.CounterVec
+	zmqSendErrors    prometheus.Counter
+	bytesIn          prometheus.Counter
+	bytesOut         prometheus.Counter
+	reloadSignals    prometheus.Counter
+}
+
+// newMetrics constructs and registers the registration-api metrics with
+// the default Prometheus registry.
+func newMetrics() *metrics {
+	m := &metrics{
+		rateLimitRejects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "conjure_registration_api_rate_limit_rejects_total",
+			Help: "Registrations rejected by the rate limiter, by dimension (ip, secret_prefix).",
+		}, []string{"dimension"}),
+		zmqSendErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "conjure_registration_api_zmq_send_errors_total",
+			Help: "Errors returned sending a registration over the ZMQ PUB socket.",
+		}),
+		bytesIn: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "conjure_registration_api_bytes_in_total",
+			Help: "Bytes read from incoming registration request bodies.",
+		}),
+		bytesOut: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "conjure_registration_api_bytes_out_total",
+			Help: "Bytes successfully sent over the ZMQ PUB socket.",
+		}),
+		reloadSignals: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "conjure_registration_api_reload_signals_total",
+			Help: "SIGHUP reload signals received.",
+		}),
+	}
+
+	prometheus.MustRegister(
+		m.rateLimitRejects,
+		m.zmqSendErrors,
+		m.bytesIn,
+		m.bytesOut,
+		m.reloadSignals,
+	)
+
+	return m
+}
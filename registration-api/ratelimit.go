@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/time/rate"
+)
+
+// Limiter decides whether a registration from a given client IP or
+// shared-secret prefix should be let through. Implementations back
+// register with either in-process or shared (Redis) limiter state.
+type Limiter interface {
+	AllowIP(ip string) bool
+	AllowSecretPrefix(prefix string) bool
+}
+
+// setupLimiter parses TrustedProxyCIDRs and (re)builds s.limiter from the
+// rate_limit_* config fields. Safe to call again on reload. A zero-valued
+// RateLimitPerIPRPS and RateLimitPerSecretRPS disables rate limiting.
+func (s *server) setupLimiter() error {
+	proxies := make([]*net.IPNet, 0, len(s.TrustedProxyCIDRs))
+	for _, cidr := range s.TrustedProxyCIDRs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid trusted_proxy_cidrs entry %q: %v", cidr, err)
+		}
+		proxies = append(proxies, ipnet)
+	}
+	s.trustedProxies = proxies
+
+	if s.RateLimitPerIPRPS <= 0 && s.RateLimitPerSecretRPS <= 0 {
+		s.limiter = nil
+		return nil
+	}
+
+	switch s.RateLimitBackend {
+	case "", "memory":
+		s.limiter = newMemoryLimiter(s.RateLimitPerIPRPS, s.RateLimitPerIPBurst, s.RateLimitPerSecretRPS, s.RateLimitPerSecretBurst)
+
+	case "redis":
+		l, err := newRedisLimiter(s.RedisAddr, s.RateLimitPerIPRPS, s.RateLimitPerIPBurst, s.RateLimitPerSecretRPS, s.RateLimitPerSecretBurst)
+		if err != nil {
+			return err
+		}
+		s.limiter = l
+
+	default:
+		return fmt.Errorf("unknown rate_limit_backend %q", s.RateLimitBackend)
+	}
+
+	return nil
+}
+
+// limiterEntryTTL is how long a per-key token bucket may sit idle before
+// it's evicted. AllowSecretPrefix's key is attacker-controlled (the client
+// supplies its own shared secret), so without eviction a client that varies
+// its secret prefix per request grows the secrets map without bound.
+const limiterEntryTTL = 10 * time.Minute
+
+// limiterSweepEvery is how often (in calls to allow) both bucket maps are
+// swept for expired entries. Amortizes the sweep instead of running it on every
+// call, while still bounding worst-case map size to roughly
+// (request rate) * limiterEntryTTL keys.
+const limiterSweepEvery = 1024
+
+// limiterEntry is a token bucket plus the last time it was touched, so
+// sweepExpiredLimiters can find and drop idle entries.
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// memoryLimiter is the default Limiter: a golang.org/x/time/rate token
+// bucket per key, created lazily on first use and evicted after
+// limiterEntryTTL of inactivity.
+type memoryLimiter struct {
+	mu sync.Mutex
+
+	ipRPS   float64
+	ipBurst int
+	ips     map[string]*limiterEntry
+
+	secretRPS   float64
+	secretBurst int
+	secrets     map[string]*limiterEntry
+
+	calls uint64
+}
+
+func newMemoryLimiter(ipRPS float64, ipBurst int, secretRPS float64, secretBurst int) *memoryLimiter {
+	return &memoryLimiter{
+		ipRPS:       ipRPS,
+		ipBurst:     ipBurst,
+		ips:         make(map[string]*limiterEntry),
+		secretRPS:   secretRPS,
+		secretBurst: secretBurst,
+		secrets:     make(map[string]*limiterEntry),
+	}
+}
+
+func (l *memoryLimiter) AllowIP(ip string) bool {
+	if l.ipRPS <= 0 {
+		return true
+	}
+	return l.allow(l.ips, ip, l.ipRPS, l.ipBurst)
+}
+
+func (l *memoryLimiter) AllowSecretPrefix(prefix string) bool {
+	if l.secretRPS <= 0 {
+		return true
+	}
+	return l.allow(l.secrets, prefix, l.secretRPS, l.secretBurst)
+}
+
+func (l *memoryLimiter) allow(buckets map[string]*limiterEntry, key string, rps float64, burst int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.calls++
+	if l.calls%limiterSweepEvery == 0 {
+		sweepExpiredLimiters(l.ips)
+		sweepExpiredLimiters(l.secrets)
+	}
+
+	entry, ok := buckets[key]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(rate.Limit(rps), burst)}
+		buckets[key] = entry
+	}
+	entry.lastUsed = time.Now()
+
+	return entry.limiter.Allow()
+}
+
+// sweepExpiredLimiters drops entries that haven't been used in
+// limiterEntryTTL. Caller must hold the memoryLimiter's mutex.
+func sweepExpiredLimiters(buckets map[string]*limiterEntry) {
+	cutoff := time.Now().Add(-limiterEntryTTL)
+	for key, entry := range buckets {
+		if entry.lastUsed.Before(cutoff) {
+			delete(buckets, key)
+		}
+	}
+}
+
+// redisGCRAScript implements GCRA (the generic cell rate algorithm) against
+// a single key holding the bucket's "theoretical arrival time" (TAT), so
+// that the configured RPS and burst are honored the same way the in-process
+// rate.Limiter honors them, and so a concurrent caller can't observe a
+// partially-applied update: the GET, the limit check, and the SET all
+// happen inside one EVAL, atomically, in a single round trip. Because the
+// TTL is set by the same SET that writes the key, a crash or network blip
+// can't leave a key with no TTL that stays rate-limited forever.
+// now/period/tat are all in microseconds; ttl_ms (the last
+// arg) is in milliseconds since that's the unit Redis's PX wants.
+const redisGCRAScript = `
+local tat = tonumber(redis.call("GET", KEYS[1]))
+local now = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local ttl_ms = tonumber(ARGV[4])
+
+if tat == nil or tat < now then
+	tat = now
+end
+
+local allow_at = tat + period - (period * burst)
+if allow_at > now then
+	return 0
+end
+
+redis.call("SET", KEYS[1], tat + period, "PX", ttl_ms)
+return 1
+`
+
+// redisLimiter is a GCRA token-bucket limiter backed by Redis, for
+// deployments running more than one registration-api instance behind a
+// shared limit. It fails open on Redis errors rather than blocking all
+// registrations because the limiter backend is unreachable.
+type redisLimiter struct {
+	client *redis.Client
+	script *redis.Script
+
+	// Periods are in microseconds rather than milliseconds: at
+	// milliseconds, any RPS over 1000 truncates to a period of 0, which
+	// allow() treats as "this dimension is disabled" — exactly backwards
+	// for a high-throughput config. Microseconds push that collapse point
+	// out to 1e6 RPS, well past anything this API would realistically be
+	// configured with.
+	ipPeriodUs     int64
+	ipBurst        int64
+	secretPeriodUs int64
+	secretBurst    int64
+}
+
+func newRedisLimiter(addr string, ipRPS float64, ipBurst int, secretRPS float64, secretBurst int) (*redisLimiter, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("rate_limit_backend redis requires redis_addr")
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %v", err)
+	}
+
+	l := &redisLimiter{client: client, script: redis.NewScript(redisGCRAScript)}
+	// A zero-or-negative RPS means that dimension is disabled, same as
+	// memoryLimiter; leaving its periodUs at zero makes allow() skip it
+	// rather than erroring, so "only rate-limit by IP" (or vice versa)
+	// works the same way under both backends.
+	if ipRPS > 0 {
+		l.ipPeriodUs = int64(1e6 / ipRPS)
+		l.ipBurst = int64(ipBurst)
+	}
+	if secretRPS > 0 {
+		l.secretPeriodUs = int64(1e6 / secretRPS)
+		l.secretBurst = int64(secretBurst)
+	}
+
+	return l, nil
+}
+
+func (l *redisLimiter) AllowIP(ip string) bool {
+	if l.ipPeriodUs == 0 {
+		return true
+	}
+	return l.allow("cj:ratelimit:ip:"+ip, l.ipPeriodUs, l.ipBurst)
+}
+
+func (l *redisLimiter) AllowSecretPrefix(prefix string) bool {
+	if l.secretPeriodUs == 0 {
+		return true
+	}
+	return l.allow("cj:ratelimit:secret:"+prefix, l.secretPeriodUs, l.secretBurst)
+}
+
+func (l *redisLimiter) allow(key string, periodUs, burst int64) bool {
+	ctx := context.Background()
+
+	// Keys for idle buckets expire on their own rather than lingering
+	// forever; a bucket can't accumulate credit past burst anyway, so this
+	// only needs to outlive one full refill of the bucket. PX wants
+	// milliseconds, so convert down from microseconds, with a 1ms floor
+	// since PX 0 is rejected by Redis.
+	ttlMs := (periodUs * (burst + 1)) / 1000
+	if ttlMs < 1 {
+		ttlMs = 1
+	}
+	nowUs := time.Now().UnixNano() / int64(time.Microsecond)
+
+	res, err := l.script.Run(ctx, l.client, []string{key}, nowUs, periodUs, burst, ttlMs).Int()
+	if err != nil {
+		return true
+	}
+
+	return res == 1
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestMemoryLimiterAllowsBurstThenBlocks(t *testing.T) {
+	l := newMemoryLimiter(1, 3, 1, 3)
+
+	for i := 0; i < 3; i++ {
+		if !l.AllowIP("1.2.3.4") {
+			t.Fatalf("AllowIP() call %d = false, want true (within burst)", i)
+		}
+	}
+	if l.AllowIP("1.2.3.4") {
+		t.Fatal("AllowIP() call 4 = true, want false (burst exhausted)")
+	}
+
+	// A different key gets its own bucket.
+	if !l.AllowIP("5.6.7.8") {
+		t.Fatal("AllowIP() for a different IP = false, want true (independent bucket)")
+	}
+}
+
+func TestMemoryLimiterDisabledWhenRPSIsZero(t *testing.T) {
+	l := newMemoryLimiter(0, 0, 0, 0)
+
+	for i := 0; i < 100; i++ {
+		if !l.AllowIP("1.2.3.4") {
+			t.Fatal("AllowIP() with RateLimitPerIPRPS <= 0 = false, want true (rate limiting disabled)")
+		}
+		if !l.AllowSecretPrefix("deadbeef") {
+			t.Fatal("AllowSecretPrefix() with RateLimitPerSecretRPS <= 0 = false, want true (rate limiting disabled)")
+		}
+	}
+}
+
+func TestMemoryLimiterSecretPrefixHasIndependentBucketFromIP(t *testing.T) {
+	l := newMemoryLimiter(1, 1, 1, 1)
+
+	if !l.AllowIP("1.2.3.4") {
+		t.Fatal("first AllowIP() = false, want true")
+	}
+	if l.AllowIP("1.2.3.4") {
+		t.Fatal("second AllowIP() = true, want false (burst of 1 exhausted)")
+	}
+	// Exhausting the IP bucket must not affect the secret-prefix bucket.
+	if !l.AllowSecretPrefix("deadbeef") {
+		t.Fatal("AllowSecretPrefix() = false, want true (independent from IP bucket)")
+	}
+}
+
+func TestSweepExpiredLimitersDropsOnlyStaleEntries(t *testing.T) {
+	buckets := map[string]*limiterEntry{
+		"stale":  {lastUsed: time.Now().Add(-2 * limiterEntryTTL)},
+		"fresh":  {lastUsed: time.Now()},
+		"recent": {lastUsed: time.Now().Add(-limiterEntryTTL / 2)},
+	}
+
+	sweepExpiredLimiters(buckets)
+
+	if _, ok := buckets["stale"]; ok {
+		t.Error(`sweepExpiredLimiters() kept "stale" entry, want evicted`)
+	}
+	if _, ok := buckets["fresh"]; !ok {
+		t.Error(`sweepExpiredLimiters() evicted "fresh" entry, want kept`)
+	}
+	if _, ok := buckets["recent"]; !ok {
+		t.Error(`sweepExpiredLimiters() evicted "recent" entry, want kept`)
+	}
+}
+
+func TestMemoryLimiterSweepsPeriodically(t *testing.T) {
+	l := newMemoryLimiter(1, 1, 1, 1)
+
+	// Seed a stale entry directly, then drive enough calls through allow()
+	// to trigger its amortized sweep and confirm the stale key is evicted
+	// rather than lingering forever.
+	l.ips["stale-key"] = &limiterEntry{
+		limiter:  rate.NewLimiter(rate.Limit(l.ipRPS), l.ipBurst),
+		lastUsed: time.Now().Add(-2 * limiterEntryTTL),
+	}
+
+	for i := uint64(0); i < limiterSweepEvery; i++ {
+		l.AllowIP("keep-warm")
+	}
+
+	if _, ok := l.ips["stale-key"]; ok {
+		t.Error("memoryLimiter.allow() did not sweep stale entry after limiterSweepEvery calls")
+	}
+}
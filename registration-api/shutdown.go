@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// shutdownTimeout bounds both how long graceful shutdown waits for the HTTP
+// server to drain in-flight requests, and how long it lingers on the ZMQ
+// PUB socket waiting for queued output to flush.
+const shutdownTimeout = 30 * time.Second
+
+// awaitShutdown blocks until SIGINT or SIGTERM, then drains in-flight
+// registrations and tears the process down in order: stop accepting new
+// HTTP requests, stop the ingest reactor and station-response listener so
+// nothing new can arrive, wait for in-flight register calls (HTTP and
+// ingest) to finish, close the transport (the zmq-pub and multi transports
+// flush and close the ZMQ PUB socket; kafka and nats leave it open), and
+// stop ZMQ CURVE auth.
+func (s *server) awaitShutdown(httpServer *http.Server) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigChan
+
+	s.logger.Printf("received %v, draining in-flight registrations\n", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		s.logger.Println("error shutting down http server:", err)
+	}
+
+	// Stop anything that can still feed messageAccepter before waiting on
+	// wg, or a frame arriving after wg.Wait() returns but before the
+	// transport closes would call Publish on an already-closed backend.
+	s.stopIngest()
+	s.stopStationResponses()
+
+	s.wg.Wait()
+
+	if s.transport != nil {
+		if err := s.transport.Close(); err != nil {
+			s.logger.Println("error closing transport:", err)
+		}
+	}
+
+	zmq.AuthStop()
+
+	s.logger.Println("shutdown complete")
+}
+
+// stopIngest tells the ingest reactor goroutine to close its sockets and
+// exit, waits for it to finish, then closes our own end of the control
+// PAIR socket (the reactor only closes its end, controlIn). A no-op if
+// ingest was never enabled.
+func (s *server) stopIngest() {
+	if s.ingestControl == nil {
+		return
+	}
+
+	// ingestControlMu keeps this from racing loadNewConfig's "reload" send
+	// on the same socket if a SIGHUP lands at roughly the same time as
+	// shutdown.
+	s.ingestControlMu.Lock()
+	_, err := s.ingestControl.SendMessage("stop")
+	s.ingestControlMu.Unlock()
+	if err != nil {
+		s.logger.Println("failed to signal ingest reactor to stop:", err)
+		return
+	}
+
+	<-s.ingestDone
+
+	if err := s.ingestControl.Close(); err != nil {
+		s.logger.Println("failed to close ingest control socket:", err)
+	}
+}
+
+// stopStationResponses tells the station response listener goroutine to
+// close its socket and exit, and waits for it to finish. A no-op if no
+// station_response_endpoints were configured.
+func (s *server) stopStationResponses() {
+	if s.stationStop == nil {
+		return
+	}
+
+	close(s.stationStop)
+	<-s.stationDone
+}
+
+// flushZMQSocket raises the PUB socket's LINGER period so Close() doesn't
+// drop whatever registrations are still queued, then closes it: Close()
+// itself blocks up to the linger period for the queue to drain. Called by
+// zmqPubTransport.Close().
+//
+// It does not poll GetEvents() for POLLOUT before closing: POLLOUT on a
+// PUB socket means "ready to accept more outbound data," not "queued
+// messages have been delivered" — it's essentially always set, so such a
+// poll would give no flush guarantee beyond what SetLinger/Close already
+// provide, and with the queue actually full (HWM reached, e.g. a dead
+// subscriber) it would spin with no deadline and hang shutdown.
+func (s *server) flushZMQSocket() {
+	if s.sock == nil {
+		return
+	}
+
+	if err := s.sock.SetLinger(shutdownTimeout); err != nil {
+		s.logger.Println("failed to set zmq linger during shutdown:", err)
+	}
+
+	if err := s.sock.Close(); err != nil {
+		s.logger.Println("failed to close zmq socket:", err)
+	}
+}
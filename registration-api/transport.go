@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	nats "github.com/nats-io/nats.go"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// Transport is the backend messageAccepter publishes a processed
+// registration (an already-marshaled C2SWrapper VSP) to. It exists so the
+// API isn't hardwired to a single ZMQ PUB deployment.
+type Transport interface {
+	Publish(ctx context.Context, message []byte) error
+	Close() error
+	Name() string
+}
+
+// setupTransport selects and constructs s.transport according to the
+// Transport config field, and points messageAccepter at it. Defaults to
+// the original zmq-pub path when Transport is unset.
+func (s *server) setupTransport() error {
+	switch s.Transport {
+	case "", "zmq-pub":
+		s.transport = &zmqPubTransport{srv: s}
+
+	case "kafka":
+		t, err := newKafkaTransport(s.KafkaBrokers, s.KafkaTopic)
+		if err != nil {
+			return err
+		}
+		s.transport = t
+
+	case "nats":
+		t, err := newNATSTransport(s.NATSUrl)
+		if err != nil {
+			return err
+		}
+		s.transport = t
+
+	case "multi":
+		t, err := newMultiTransport(s)
+		if err != nil {
+			return err
+		}
+		s.transport = t
+
+	default:
+		return fmt.Errorf("unknown transport %q", s.Transport)
+	}
+
+	s.messageAccepter = func(message []byte) error {
+		return s.transport.Publish(context.Background(), message)
+	}
+	return nil
+}
+
+// zmqPubTransport is the original ZMQ PUB publishing path, now behind the
+// Transport interface. It reuses the server's own sock and mutex rather
+// than owning its own, so nothing about the existing ZMQ send flow or its
+// locking changes.
+type zmqPubTransport struct {
+	srv *server
+}
+
+func (t *zmqPubTransport) Publish(_ context.Context, message []byte) error {
+	return t.srv.sendToZMQ(message)
+}
+
+func (t *zmqPubTransport) Close() error {
+	t.srv.flushZMQSocket()
+	return nil
+}
+
+func (t *zmqPubTransport) Name() string {
+	return "zmq-pub"
+}
+
+// kafkaTransport publishes to Kafka, keying each message on the
+// registration's shared-secret prefix so repeated registrations for the
+// same client land on the same station partition.
+type kafkaTransport struct {
+	writer *kafka.Writer
+}
+
+func newKafkaTransport(brokers []string, topic string) (*kafkaTransport, error) {
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("kafka transport requires at least one broker")
+	}
+	if topic == "" {
+		return nil, fmt.Errorf("kafka transport requires a topic")
+	}
+
+	return &kafkaTransport{
+		writer: &kafka.Writer{
+			Addr:     kafka.TCP(brokers...),
+			Topic:    topic,
+			Balancer: &kafka.Hash{},
+		},
+	}, nil
+}
+
+func (t *kafkaTransport) Publish(ctx context.Context, message []byte) error {
+	key, err := sharedSecretPrefix(message)
+	if err != nil {
+		return err
+	}
+	return t.writer.WriteMessages(ctx, kafka.Message{Key: key, Value: message})
+}
+
+func (t *kafkaTransport) Close() error {
+	return t.writer.Close()
+}
+
+func (t *kafkaTransport) Name() string {
+	return "kafka"
+}
+
+// natsTransport publishes to NATS on a subject derived from the
+// registration's RegistrationSource.
+type natsTransport struct {
+	conn *nats.Conn
+}
+
+func newNATSTransport(url string) (*natsTransport, error) {
+	if url == "" {
+		return nil, fmt.Errorf("nats transport requires nats_url")
+	}
+
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %v", err)
+	}
+
+	return &natsTransport{conn: conn}, nil
+}
+
+func (t *natsTransport) Publish(_ context.Context, message []byte) error {
+	payload := &pb.C2SWrapper{}
+	if err := proto.Unmarshal(message, payload); err != nil {
+		return fmt.Errorf("failed to decode C2SWrapper for nats subject: %v", err)
+	}
+
+	subject := fmt.Sprintf("conjure.registrations.%s", payload.GetRegistrationSource())
+	return t.conn.Publish(subject, message)
+}
+
+func (t *natsTransport) Close() error {
+	t.conn.Close()
+	return nil
+}
+
+func (t *natsTransport) Name() string {
+	return "nats"
+}
+
+// multiTransport fans a registration out to several backends at once, so
+// operators can dual-write during a migration between transports. Publish
+// and Close both run every sub-transport and aggregate any errors rather
+// than stopping at the first failure.
+type multiTransport struct {
+	transports []Transport
+}
+
+// newMultiTransport builds a multiTransport from whichever backends have
+// configuration set: zmq-pub is always included, kafka and nats join in
+// when their respective config fields are non-empty.
+func newMultiTransport(s *server) (*multiTransport, error) {
+	transports := []Transport{&zmqPubTransport{srv: s}}
+
+	if len(s.KafkaBrokers) > 0 {
+		t, err := newKafkaTransport(s.KafkaBrokers, s.KafkaTopic)
+		if err != nil {
+			return nil, err
+		}
+		transports = append(transports, t)
+	}
+
+	if s.NATSUrl != "" {
+		t, err := newNATSTransport(s.NATSUrl)
+		if err != nil {
+			return nil, err
+		}
+		transports = append(transports, t)
+	}
+
+	return &multiTransport{transports: transports}, nil
+}
+
+func (t *multiTransport) Publish(ctx context.Context, message []byte) error {
+	var errs []string
+	for _, sub := range t.transports {
+		if err := sub.Publish(ctx, message); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", sub.Name(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("multi transport publish errors: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (t *multiTransport) Close() error {
+	var errs []string
+	for _, sub := range t.transports {
+		if err := sub.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", sub.Name(), err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("multi transport close errors: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (t *multiTransport) Name() string {
+	return "multi"
+}
+
+// sharedSecretPrefix pulls the Kafka partition key out of an
+// already-marshaled C2SWrapper: the first regIDLen/2 bytes of its shared
+// secret, the same prefix used elsewhere as the registration's
+// correlation/log ID.
+func sharedSecretPrefix(message []byte) ([]byte, error) {
+	payload := &pb.C2SWrapper{}
+	if err := proto.Unmarshal(message, payload); err != nil {
+		return nil, fmt.Errorf("failed to decode C2SWrapper for partition key: %v", err)
+	}
+
+	secret := payload.GetSharedSecret()
+	if len(secret) < regIDLen/2 {
+		return nil, fmt.Errorf("shared secret too short to derive partition key")
+	}
+	return secret[:regIDLen/2], nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/refraction-networking/gotapdance/protobuf"
+)
+
+func TestSetupTransportSelection(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport string
+		wantName  string
+		wantErr   bool
+	}{
+		{name: "default is zmq-pub", transport: "", wantName: "zmq-pub"},
+		{name: "explicit zmq-pub", transport: "zmq-pub", wantName: "zmq-pub"},
+		{name: "kafka requires brokers and topic", transport: "kafka", wantErr: true},
+		{name: "nats requires nats_url", transport: "nats", wantErr: true},
+		{name: "unknown transport errors", transport: "carrier-pigeon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server{}
+			s.Transport = tt.transport
+
+			err := s.setupTransport()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("setupTransport(%q) = nil error, want error", tt.transport)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("setupTransport(%q) = %v, want no error", tt.transport, err)
+			}
+			if got := s.transport.Name(); got != tt.wantName {
+				t.Fatalf("setupTransport(%q) selected transport %q, want %q", tt.transport, got, tt.wantName)
+			}
+			if s.messageAccepter == nil {
+				t.Fatalf("setupTransport(%q) left messageAccepter nil", tt.transport)
+			}
+		})
+	}
+}
+
+func TestSetupTransportMultiRequiresNoExtraConfig(t *testing.T) {
+	s := &server{}
+	s.Transport = "multi"
+
+	if err := s.setupTransport(); err != nil {
+		t.Fatalf("setupTransport(multi) with no kafka/nats config = %v, want no error", err)
+	}
+	if got := s.transport.Name(); got != "multi" {
+		t.Fatalf("setupTransport(multi) selected transport %q, want multi", got)
+	}
+}
+
+func TestSharedSecretPrefix(t *testing.T) {
+	secret := make([]byte, SecretLength)
+	for i := range secret {
+		secret[i] = byte(i)
+	}
+	message, err := proto.Marshal(&pb.C2SWrapper{SharedSecret: secret})
+	if err != nil {
+		t.Fatalf("failed to marshal test C2SWrapper: %v", err)
+	}
+
+	prefix, err := sharedSecretPrefix(message)
+	if err != nil {
+		t.Fatalf("sharedSecretPrefix() = %v, want no error", err)
+	}
+	if len(prefix) != regIDLen/2 {
+		t.Fatalf("sharedSecretPrefix() returned %d bytes, want %d", len(prefix), regIDLen/2)
+	}
+	for i, b := range prefix {
+		if b != byte(i) {
+			t.Fatalf("sharedSecretPrefix()[%d] = %d, want %d", i, b, i)
+		}
+	}
+}
+
+func TestSharedSecretPrefixTooShort(t *testing.T) {
+	message, err := proto.Marshal(&pb.C2SWrapper{SharedSecret: []byte{0x01, 0x02}})
+	if err != nil {
+		t.Fatalf("failed to marshal test C2SWrapper: %v", err)
+	}
+
+	if _, err := sharedSecretPrefix(message); err == nil {
+		t.Fatal("sharedSecretPrefix() with short secret = nil error, want error")
+	}
+}